@@ -1,16 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/gob"
 	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"io"
 
@@ -22,20 +33,328 @@ import (
 
 	firebase "firebase.google.com/go"
 	"firebase.google.com/go/messaging"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+
+	"github.com/Samasaur1/cliff-server/store"
 )
 
 var (
-	hostname    = flag.String("hostname", "cliff", "The hostname to use on the tailnet")
-	apnsKey     = flag.String("apns-key", os.Getenv("CLIFF_APNS_KEY_PATH"), "Path to the APNs token signing key")
-	keyID       = flag.String("key-id", os.Getenv("CLIFF_APNS_KEY_ID"), "ID of the APNs token signing key")
-	teamID      = flag.String("team-id", os.Getenv("CLIFF_APNS_TEAM_ID"), "ID of the team signing the app")
-	bundleID    = flag.String("bundle-id", os.Getenv("CLIFF_APP_BUNDLE_ID"), "Bundle ID of the app receiving notifications")
-	development = flag.Bool("development", false, "Whether to send APNs notifications to the dev environment")
+	hostname       = flag.String("hostname", "cliff", "The hostname to use on the tailnet")
+	apnsKey        = flag.String("apns-key", os.Getenv("CLIFF_APNS_KEY_PATH"), "Path to the APNs token signing key")
+	keyID          = flag.String("key-id", os.Getenv("CLIFF_APNS_KEY_ID"), "ID of the APNs token signing key")
+	teamID         = flag.String("team-id", os.Getenv("CLIFF_APNS_TEAM_ID"), "ID of the team signing the app")
+	bundleID       = flag.String("bundle-id", os.Getenv("CLIFF_APP_BUNDLE_ID"), "Bundle ID of the app receiving notifications")
+	development    = flag.Bool("development", false, "Whether to send APNs notifications to the dev environment")
+	wnsSID         = flag.String("wns-sid", os.Getenv("CLIFF_WNS_SID"), "Package SID of the Windows app receiving notifications")
+	wnsSecret      = flag.String("wns-secret", os.Getenv("CLIFF_WNS_SECRET"), "Client secret for the Windows app receiving notifications")
+	vapidKey       = flag.String("vapid-key", os.Getenv("CLIFF_VAPID_KEY_PATH"), "Path to a PEM-encoded EC P-256 key used to sign Web Push VAPID JWTs; Web Push is disabled if unset")
+	vapidSubject   = flag.String("vapid-subject", os.Getenv("CLIFF_VAPID_SUBJECT"), "Contact URI (mailto: or https:) sent in the Web Push VAPID JWT")
+	workers        = flag.Int("workers", 4, "Number of background workers delivering queued notifications")
+	dbPath         = flag.String("db", "cliff.db", "Path to the SQLite database file")
+	migrateFromGob = flag.Bool("migrate-from-gob", false, "Import registrations from an existing devices.gob file into the database, then exit")
 )
 
+// loadVAPIDKeys reads a PEM-encoded EC P-256 private key and returns the
+// base64url-encoded private and public key pair that webpush-go expects.
+func loadVAPIDKeys(path string) (privateKey, publicKey string, err error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return "", "", fmt.Errorf("no PEM block found in %s", path)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return "", "", err
+	}
+	if key.Curve != elliptic.P256() {
+		return "", "", fmt.Errorf("VAPID key must use the P-256 curve")
+	}
+
+	d := make([]byte, 32)
+	key.D.FillBytes(d)
+	pub := elliptic.Marshal(key.Curve, key.X, key.Y)
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(d), enc.EncodeToString(pub), nil
+}
+
+// MARK: - legacy device data types
+//
+// These mirror the devices.gob layout from before cliff moved to SQLite.
+// They only exist so --migrate-from-gob can still decode an old snapshot.
+
+type legacyDeviceData struct {
+	NodeNameAtRegistration string
+	ApnsToken              string
+}
+type legacyFcmDeviceData struct {
+	NodeNameAtRegistration string
+	FcmToken               string
+}
+type legacyWnsDeviceData struct {
+	NodeNameAtRegistration string
+	ChannelURI             string
+}
+type legacyUserData struct {
+	UsernameAtRegistration string
+	Devices                map[tailcfg.StableNodeID]legacyDeviceData
+	FcmDevices             map[tailcfg.StableNodeID]legacyFcmDeviceData
+	WnsDevices             map[tailcfg.StableNodeID]legacyWnsDeviceData
+}
+
+// migrateFromGobFile reads an old devices.gob snapshot and imports every
+// user and device it finds into st.
+func migrateFromGobFile(path string, st *store.Store) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var legacy map[tailcfg.UserID]legacyUserData
+	if err := gob.NewDecoder(file).Decode(&legacy); err != nil {
+		return err
+	}
+
+	for uid, userData := range legacy {
+		userID := int64(uid)
+		if err := st.UpsertUser(userID, userData.UsernameAtRegistration); err != nil {
+			return err
+		}
+		for nodeID, d := range userData.Devices {
+			if err := st.UpsertDevice(userID, string(nodeID), "apns", d.ApnsToken, d.NodeNameAtRegistration); err != nil {
+				return err
+			}
+		}
+		for nodeID, d := range userData.FcmDevices {
+			if err := st.UpsertDevice(userID, string(nodeID), "fcm", d.FcmToken, d.NodeNameAtRegistration); err != nil {
+				return err
+			}
+		}
+		for nodeID, d := range userData.WnsDevices {
+			if err := st.UpsertDevice(userID, string(nodeID), "wns", d.ChannelURI, d.NodeNameAtRegistration); err != nil {
+				return err
+			}
+		}
+		log.Printf("..imported %d APNs, %d FCM, %d WNS device(s) for user %s",
+			len(userData.Devices), len(userData.FcmDevices), len(userData.WnsDevices), userData.UsernameAtRegistration)
+	}
+	return nil
+}
+
+type NotificationContent struct {
+	Title             string            `json:"title"`
+	Subtitle          string            `json:"subtitle"`
+	Body              string            `json:"body"`
+	Data              map[string]string `json:"data,omitempty"`
+	Badge             *int              `json:"badge,omitempty"`
+	Sound             string            `json:"sound,omitempty"`
+	Priority          string            `json:"priority,omitempty"` // "high" or "normal"
+	TTLSeconds        int               `json:"ttl_seconds,omitempty"`
+	CollapseKey       string            `json:"collapse_key,omitempty"`
+	ClickAction       string            `json:"click_action,omitempty"`
+	InterruptionLevel string            `json:"interruption_level,omitempty"` // "passive", "active", "time-sensitive", or "critical"
+	MutableContent    bool              `json:"mutable_content,omitempty"`
+	ContentAvailable  bool              `json:"content_available,omitempty"`
+	ThreadID          string            `json:"thread_id,omitempty"`
+	Device            string            `json:"device,omitempty"`         // StableNodeID to target; empty means all devices
+	ExcludeDevice     string            `json:"exclude_device,omitempty"` // StableNodeID to skip, e.g. the sender's own device
+	Silent            bool              `json:"-"`                        // set internally for /dismiss pushes; never accepted from clients
+}
+
+// notificationContentFromForm builds a NotificationContent out of a
+// form-encoded /send request; the richer fields are optional and fall back
+// to the zero value when absent.
+func notificationContentFromForm(form url.Values) (NotificationContent, error) {
+	nc := NotificationContent{
+		Title:             form.Get("title"),
+		Subtitle:          form.Get("subtitle"),
+		Body:              form.Get("body"),
+		Sound:             form.Get("sound"),
+		Priority:          form.Get("priority"),
+		CollapseKey:       form.Get("collapse_key"),
+		ClickAction:       form.Get("click_action"),
+		InterruptionLevel: form.Get("interruption_level"),
+		ThreadID:          form.Get("thread_id"),
+		Device:            form.Get("device"),
+		ExcludeDevice:     form.Get("exclude_device"),
+	}
+
+	if raw := form.Get("badge"); raw != "" {
+		badge, err := strconv.Atoi(raw)
+		if err != nil {
+			return nc, fmt.Errorf("invalid badge: %w", err)
+		}
+		nc.Badge = &badge
+	}
+	if raw := form.Get("ttl_seconds"); raw != "" {
+		ttl, err := strconv.Atoi(raw)
+		if err != nil {
+			return nc, fmt.Errorf("invalid ttl_seconds: %w", err)
+		}
+		nc.TTLSeconds = ttl
+	}
+	if raw := form.Get("mutable_content"); raw != "" {
+		mutableContent, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nc, fmt.Errorf("invalid mutable_content: %w", err)
+		}
+		nc.MutableContent = mutableContent
+	}
+	if raw := form.Get("content_available"); raw != "" {
+		contentAvailable, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nc, fmt.Errorf("invalid content_available: %w", err)
+		}
+		nc.ContentAvailable = contentAvailable
+	}
+	if raw := form.Get("data"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &nc.Data); err != nil {
+			return nc, fmt.Errorf("invalid data: %w", err)
+		}
+	}
+
+	return nc, nil
+}
+
+// job is one queued notification send, persisted in the store so in-flight
+// work survives a restart and removed once delivery finishes. NotificationID
+// is assigned at enqueue time (rather than when it's finally recorded in
+// history) so that /send and /sendJSON can hand it back to the caller for
+// later use with /dismiss. Silent carries NotificationContent.Silent, which
+// is left out of NotificationContent's own JSON encoding.
+type job struct {
+	UID            tailcfg.UserID
+	Notification   NotificationContent
+	NotificationID string
+	Silent         bool
+}
+
+// notificationHistoryEntry augments a stored notification with a
+// {success, failure, cleaned} summary of its delivery results. Sends are
+// queued and delivered asynchronously, so /send and /sendJSON return only the
+// notification ID; the summary is read off the corresponding /history entry.
+type notificationHistoryEntry struct {
+	store.Notification
+	Success int      `json:"success"`
+	Failure int      `json:"failure"`
+	Cleaned []string `json:"cleaned"`
+}
+
+// summarizeDelivery reduces a notification's per-device delivery results
+// down to success/failure counts plus the node IDs that were cleaned up as
+// dead tokens/subscriptions along the way.
+func summarizeDelivery(delivery map[string]string) (success, failure int, cleaned []string) {
+	cleaned = []string{}
+	for nodeID, result := range delivery {
+		if result == "sent" {
+			success++
+			continue
+		}
+		failure++
+		if strings.HasPrefix(result, "removed:") {
+			cleaned = append(cleaned, nodeID)
+		}
+	}
+	return success, failure, cleaned
+}
+
+// filterDevices narrows devices down to a single target device and/or with
+// one device excluded; either may be empty to skip that filter.
+func filterDevices(devices []store.Device, target, exclude string) []store.Device {
+	if target == "" && exclude == "" {
+		return devices
+	}
+	filtered := make([]store.Device, 0, len(devices))
+	for _, d := range devices {
+		if target != "" && d.NodeID != target {
+			continue
+		}
+		if exclude != "" && d.NodeID == exclude {
+			continue
+		}
+		filtered = append(filtered, d)
+	}
+	return filtered
+}
+
+const (
+	maxSendRetries = 6 // initial attempt + 5 retries
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+	fcmBatchSize   = 500 // SendMulticast's per-call token limit
+)
+
+// withRetry calls attempt until it succeeds, attempt reports the error as
+// non-transient, or maxAttempts is reached, backing off exponentially
+// between transient failures.
+func withRetry(maxAttempts int, attempt func() (transient bool, err error)) error {
+	backoff := initialBackoff
+	var err error
+	for i := 0; i < maxAttempts; i++ {
+		var transient bool
+		transient, err = attempt()
+		if err == nil {
+			return nil
+		}
+		if !transient || i == maxAttempts-1 {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	return err
+}
+
+// loadQueuedJobs reads back any jobs left over from a previous run so they
+// aren't dropped on restart, decoding each row's opaque data back into a job.
+func loadQueuedJobs(st *store.Store) []job {
+	rows, err := st.QueuedJobs()
+	if err != nil {
+		log.Printf("..unable to load queued jobs: %s", err.Error())
+		return nil
+	}
+
+	var jobs []job
+	for _, row := range rows {
+		var j job
+		if err := json.Unmarshal(row.Data, &j); err != nil {
+			log.Printf("..unable to decode queued job %s, discarding it: %s", row.ID, err.Error())
+			if err := st.DequeueJob(row.ID); err != nil {
+				log.Printf("..unable to remove corrupt queued job %s: %s", row.ID, err.Error())
+			}
+			continue
+		}
+		j.Notification.Silent = j.Silent
+		jobs = append(jobs, j)
+	}
+	return jobs
+}
+
 func main() {
 	flag.Parse()
 
+	if *migrateFromGob {
+		st, err := store.Open(*dbPath)
+		if err != nil {
+			log.Fatal("Unable to open database:", err)
+		}
+		defer st.Close()
+
+		if err := migrateFromGobFile("devices.gob", st); err != nil {
+			log.Fatal("Migration failed:", err)
+		}
+		log.Printf("Migration complete")
+		return
+	}
+
 	if *apnsKey == "" {
 		flag.PrintDefaults()
 		log.Fatal("Must provide a path to the APNs key file (can use the CLIFF_APNS_KEY_PATH env var)")
@@ -54,7 +373,7 @@ func main() {
 	}
 
 	// MARK: - APNs client setup
-	log.Printf("[1/6] Creating APNs client")
+	log.Printf("[1/9] Creating APNs client")
 
 	authKey, err := token.AuthKeyFromFile(*apnsKey)
 	if err != nil {
@@ -73,7 +392,7 @@ func main() {
 		apnsClient.Production()
 	}
 
-	log.Printf("[2/6] Creating FCM client")
+	log.Printf("[2/9] Creating FCM client")
 
 	app, err := firebase.NewApp(context.Background(), nil)
 	if err != nil {
@@ -84,8 +403,78 @@ func main() {
 		log.Fatal("Unable to create FCM client")
 	}
 
+	// MARK: - WNS client setup
+	log.Printf("[3/9] Creating WNS client")
+
+	// wnsAccessToken caches the bearer token returned by login.live.com so we
+	// don't re-authenticate on every push; it's refreshed on expiry or a 401.
+	type wnsAccessToken struct {
+		mu        sync.Mutex
+		token     string
+		expiresAt time.Time
+	}
+	wnsToken := &wnsAccessToken{}
+
+	fetchWnsAccessToken := func() (string, error) {
+		form := url.Values{}
+		form.Set("grant_type", "client_credentials")
+		form.Set("client_id", *wnsSID)
+		form.Set("client_secret", *wnsSecret)
+		form.Set("scope", "notify.windows.com")
+
+		resp, err := http.PostForm("https://login.live.com/accesstoken.srf", form)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("WNS token request failed with status %d", resp.StatusCode)
+		}
+
+		var body struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return "", err
+		}
+
+		wnsToken.mu.Lock()
+		wnsToken.token = body.AccessToken
+		wnsToken.expiresAt = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+		wnsToken.mu.Unlock()
+
+		return body.AccessToken, nil
+	}
+
+	getWnsAccessToken := func() (string, error) {
+		wnsToken.mu.Lock()
+		token := wnsToken.token
+		valid := token != "" && time.Now().Before(wnsToken.expiresAt)
+		wnsToken.mu.Unlock()
+
+		if valid {
+			return token, nil
+		}
+		return fetchWnsAccessToken()
+	}
+
+	// MARK: - Web Push client setup
+	log.Printf("[4/9] Setting up Web Push")
+
+	var vapidPrivateKey, vapidPublicKey string
+	if *vapidKey != "" {
+		vapidPrivateKey, vapidPublicKey, err = loadVAPIDKeys(*vapidKey)
+		if err != nil {
+			log.Fatal("Unable to load VAPID key:", err)
+		}
+	} else {
+		log.Printf("..no --vapid-key provided, Web Push is disabled")
+	}
+
 	// MARK: - Tailscale setup
-	log.Printf("[3/6] Connecting to Tailscale")
+	log.Printf("[5/9] Connecting to Tailscale")
 
 	s := new(tsnet.Server)
 	s.Hostname = *hostname
@@ -102,139 +491,506 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// MARK: - device data setup
-	log.Printf("[4/6] Loading registered devices")
+	// MARK: - storage setup
+	log.Printf("[6/9] Opening database")
 
-	type DeviceData struct {
-		NodeNameAtRegistration string
-		ApnsToken              string
-	}
-	type FcmDeviceData struct {
-		NodeNameAtRegistration string
-		FcmToken               string
-	}
-	type UserData struct {
-		UsernameAtRegistration string
-		Devices                map[tailcfg.StableNodeID]DeviceData
-		FcmDevices             map[tailcfg.StableNodeID]FcmDeviceData
+	st, err := store.Open(*dbPath)
+	if err != nil {
+		log.Fatal("Unable to open database:", err)
 	}
-	var devices map[tailcfg.UserID]UserData
+	defer st.Close()
 
-	file, err := os.Open("devices.gob")
-	if err == nil {
-		decoder := gob.NewDecoder(file)
-		err := decoder.Decode(&devices)
+	interruptChannel := make(chan os.Signal, 1)
+	signal.Notify(interruptChannel, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interruptChannel
 
-		if err != nil {
-			devices = map[tailcfg.UserID]UserData{}
-		}
+		st.Close()
 
-		file.Close()
-	} else {
-		devices = map[tailcfg.UserID]UserData{}
-	}
+		os.Exit(0)
+	}()
+
+	// MARK: - delivery queue setup
+	log.Printf("[7/9] Starting delivery workers")
 
-	for _, userData := range devices {
-		log.Printf("Loaded user %s", userData.UsernameAtRegistration)
+	jobQueue := make(chan job, 256)
 
-		// These nil checks don't appear to work. Whatever
-		if userData.Devices == nil {
-			userData.Devices = map[tailcfg.StableNodeID]DeviceData{}
+	queuedJobs := loadQueuedJobs(st)
+	if len(queuedJobs) > 0 {
+		log.Printf("..replaying %d notification(s) left over from last run", len(queuedJobs))
+	}
+	// Feed the backlog in from a goroutine rather than blocking main(): if
+	// more jobs are queued than jobQueue's buffer, this would otherwise
+	// deadlock here, before the workers that drain it are even started.
+	go func() {
+		for _, j := range queuedJobs {
+			jobQueue <- j
 		}
-		for _, deviceData := range userData.Devices {
-			log.Printf("..loaded device %s for user %s", deviceData.NodeNameAtRegistration, userData.UsernameAtRegistration)
+	}()
+
+	enqueueJob := func(uid tailcfg.UserID, nc NotificationContent) (string, error) {
+		id, err := store.NewID()
+		if err != nil {
+			return "", err
 		}
-		if userData.FcmDevices == nil {
-			userData.FcmDevices = map[tailcfg.StableNodeID]FcmDeviceData{}
+		j := job{UID: uid, Notification: nc, NotificationID: id, Silent: nc.Silent}
+
+		data, err := json.Marshal(j)
+		if err != nil {
+			return "", err
 		}
-		for _, fcmDeviceData := range userData.FcmDevices {
-			log.Printf("..loaded FCM device %s for user %s", fcmDeviceData.NodeNameAtRegistration, userData.UsernameAtRegistration)
+		enqueueErr := st.EnqueueJob(id, int64(uid), data)
+
+		jobQueue <- j
+		return id, enqueueErr
+	}
+
+	markDelivered := func(notificationID string) {
+		if err := st.DequeueJob(notificationID); err != nil {
+			log.Printf("..unable to remove delivered job %s from the queue: %s", notificationID, err.Error())
 		}
 	}
 
-	interruptChannel := make(chan os.Signal, 1)
-	signal.Notify(interruptChannel, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-interruptChannel
+	deliverNotification := func(uid tailcfg.UserID, nc NotificationContent, notificationID string) {
+		userID := int64(uid)
 
-		file, err := os.Create("devices.gob")
-		if err != nil {
-			log.Printf("Unable to create file! err: %s", err.Error())
-		}
+		apnsPayload := payload.NewPayload()
+		var fcmNotification *messaging.Notification
+		pushType := apns2.PushTypeAlert
 
-		encoder := gob.NewEncoder(file)
-		encoder.Encode(devices)
+		if nc.Silent {
+			// A dismissal push carries no alert, just a content-available
+			// wakeup; fcmNotification stays nil so FCM treats it as a
+			// data-only message.
+			apnsPayload.ContentAvailable()
+			pushType = apns2.PushTypeBackground
+		} else {
+			fcmNotification = &messaging.Notification{}
+			if nc.Title != "" {
+				apnsPayload.AlertTitle(nc.Title)
+				fcmNotification.Title = nc.Title
+			}
+			if nc.Subtitle != "" {
+				apnsPayload.AlertSubtitle(nc.Subtitle)
+			}
+			if nc.Body != "" {
+				apnsPayload.AlertBody(nc.Body)
+				fcmNotification.Body = nc.Body
+			}
 
-		file.Close()
+			sound := nc.Sound
+			if sound == "" {
+				sound = "default"
+			}
+			apnsPayload.Sound(sound)
 
-		os.Exit(0)
-	}()
+			interruptionLevel := payload.InterruptionLevelTimeSensitive
+			switch nc.InterruptionLevel {
+			case "passive":
+				interruptionLevel = payload.InterruptionLevelPassive
+			case "active":
+				interruptionLevel = payload.InterruptionLevelActive
+			case "critical":
+				interruptionLevel = payload.InterruptionLevelCritical
+			}
+			apnsPayload.InterruptionLevel(interruptionLevel)
 
-	// MARK: - route setup
-	log.Printf("[5/6] Creating routes")
+			if nc.Badge != nil {
+				apnsPayload.Badge(*nc.Badge)
+			}
+			if nc.ThreadID != "" {
+				apnsPayload.ThreadID(nc.ThreadID)
+			}
+			if nc.MutableContent {
+				apnsPayload.MutableContent()
+			}
+			if nc.ContentAvailable {
+				apnsPayload.ContentAvailable()
+			}
+		}
+		for k, v := range nc.Data {
+			apnsPayload.Custom(k, v)
+		}
 
-	type NotificationContent struct {
-		Title    string `json:"title"`
-		Subtitle string `json:"subtitle"`
-		Body     string `json:"body"`
-	}
+		sound := nc.Sound
+		if sound == "" {
+			sound = "default"
+		}
 
-	sendNotification := func(w http.ResponseWriter, uid tailcfg.UserID, nc NotificationContent) {
-		apnsPayload := payload.NewPayload()
-		fcmNotification := messaging.Notification{}
-		if nc.Title != "" {
-			apnsPayload.AlertTitle(nc.Title)
-			fcmNotification.Title = nc.Title
+		apnsPriority := 0 // let APNs pick its default
+		androidPriority := "high"
+		if nc.Priority == "normal" {
+			apnsPriority = apns2.PriorityLow
+			androidPriority = "normal"
+		} else if nc.Priority == "high" {
+			apnsPriority = apns2.PriorityHigh
 		}
-		if nc.Subtitle != "" {
-			apnsPayload.AlertSubtitle(nc.Subtitle)
+		if nc.Silent {
+			// Dismissals need to arrive promptly regardless of the
+			// notification's own priority. APNs also requires
+			// apns-priority: 5 on every apns-push-type: background push,
+			// so force it rather than leaving apnsPriority unset.
+			androidPriority = "high"
+			apnsPriority = apns2.PriorityLow
 		}
-		if nc.Body != "" {
-			apnsPayload.AlertBody(nc.Body)
-			fcmNotification.Body = nc.Body
+
+		androidNotification := &messaging.AndroidNotification{
+			ClickAction: nc.ClickAction,
+			Sound:       nc.Sound,
+		}
+		if nc.Badge != nil {
+			androidNotification.NotificationCount = nc.Badge
+		}
+		androidConfig := &messaging.AndroidConfig{
+			Priority:     androidPriority,
+			CollapseKey:  nc.CollapseKey,
+			Notification: androidNotification,
+		}
+		if nc.TTLSeconds > 0 {
+			ttl := time.Duration(nc.TTLSeconds) * time.Second
+			androidConfig.TTL = &ttl
 		}
-		apnsPayload.Sound("default").InterruptionLevel(payload.InterruptionLevelTimeSensitive)
 
-		// Send to all APNs devices
-		for _, deviceData := range devices[uid].Devices {
+		// FCM can also bridge messages to APNs devices registered through
+		// Firebase; populate the parallel APNs config so that path gets the
+		// same rich fields.
+		apnsCustomData := make(map[string]interface{}, len(nc.Data))
+		for k, v := range nc.Data {
+			apnsCustomData[k] = v
+		}
+		fcmApnsConfig := &messaging.APNSConfig{
+			Headers: map[string]string{},
+			Payload: &messaging.APNSPayload{
+				Aps: &messaging.Aps{
+					Alert: &messaging.ApsAlert{
+						Title:    nc.Title,
+						SubTitle: nc.Subtitle,
+						Body:     nc.Body,
+					},
+					Sound:            sound,
+					Badge:            nc.Badge,
+					ThreadID:         nc.ThreadID,
+					MutableContent:   nc.MutableContent,
+					ContentAvailable: nc.ContentAvailable,
+				},
+				CustomData: apnsCustomData,
+			},
+		}
+		if nc.CollapseKey != "" {
+			fcmApnsConfig.Headers["apns-collapse-id"] = nc.CollapseKey
+		}
+		if nc.TTLSeconds > 0 {
+			fcmApnsConfig.Headers["apns-expiration"] = strconv.FormatInt(time.Now().Add(time.Duration(nc.TTLSeconds)*time.Second).Unix(), 10)
+		}
+		switch nc.Priority {
+		case "high":
+			fcmApnsConfig.Headers["apns-priority"] = "10"
+		case "normal":
+			fcmApnsConfig.Headers["apns-priority"] = "5"
+		}
+		if nc.Silent {
+			// Keep the dismissal data-only on the FCM side too: no Android
+			// notification block and no APNs alert or sound on the bridge.
+			androidConfig.Notification = nil
+			fcmApnsConfig.Payload.Aps = &messaging.Aps{ContentAvailable: true}
+			fcmApnsConfig.Headers["apns-push-type"] = "background"
+			fcmApnsConfig.Headers["apns-priority"] = "5"
+		}
+
+		webpushPayload, err := json.Marshal(struct {
+			Title string            `json:"title,omitempty"`
+			Body  string            `json:"body,omitempty"`
+			Data  map[string]string `json:"data,omitempty"`
+		}{Title: nc.Title, Body: nc.Body, Data: nc.Data})
+		if err != nil {
+			log.Printf("..unable to build Web Push payload: %s", err.Error())
+		}
+
+		delivery := map[string]string{}
+
+		apnsDevices, err := st.DevicesForUser(userID, "apns")
+		if err != nil {
+			log.Printf("..unable to load APNs devices: %s", err.Error())
+		}
+		apnsDevices = filterDevices(apnsDevices, nc.Device, nc.ExcludeDevice)
+		// Send to all targeted APNs devices
+		for _, deviceData := range apnsDevices {
 			notification := &apns2.Notification{
-				DeviceToken: deviceData.ApnsToken,
+				DeviceToken: deviceData.Token,
 				Topic:       *bundleID,
 				Payload:     apnsPayload,
+				CollapseID:  nc.CollapseKey,
+				PushType:    pushType,
+			}
+			if apnsPriority != 0 {
+				notification.Priority = apnsPriority
+			}
+			if nc.TTLSeconds > 0 {
+				notification.Expiration = time.Now().Add(time.Duration(nc.TTLSeconds) * time.Second)
+			}
+
+			log.Printf("..sending APNS notification to %s", deviceData.NodeName)
+			var reason string
+			err := withRetry(maxSendRetries, func() (bool, error) {
+				res, err := apnsClient.Push(notification)
+				if err != nil {
+					return true, err
+				}
+				if res.Sent() {
+					return false, nil
+				}
+				reason = res.Reason
+				if reason == apns2.ReasonTooManyRequests {
+					return true, fmt.Errorf("rate limited")
+				}
+				return false, fmt.Errorf("rejected: %s", reason)
+			})
+			if err != nil {
+				log.Printf("....unable to send notification: %s", err.Error())
+				delivery[deviceData.NodeID] = "error: " + err.Error()
+				switch reason {
+				case apns2.ReasonUnregistered, apns2.ReasonBadDeviceToken, apns2.ReasonDeviceTokenNotForTopic:
+					log.Printf("....removing dead APNs device %s", deviceData.NodeName)
+					if err := st.DeleteDevice(userID, deviceData.NodeID, "apns"); err != nil {
+						log.Printf("....unable to remove dead APNs device: %s", err.Error())
+					}
+					delivery[deviceData.NodeID] = "removed: " + reason
+				}
+			} else {
+				delivery[deviceData.NodeID] = "sent"
+			}
+		}
+
+		fcmDevices, err := st.DevicesForUser(userID, "fcm")
+		if err != nil {
+			log.Printf("..unable to load FCM devices: %s", err.Error())
+		}
+		fcmDevices = filterDevices(fcmDevices, nc.Device, nc.ExcludeDevice)
+		// Send to all targeted FCM devices, chunked to stay under the
+		// per-call token limit of SendMulticast.
+		var fcmSuccess, fcmFailure int
+		var fcmCleaned []string
+		for start := 0; start < len(fcmDevices); start += fcmBatchSize {
+			end := start + fcmBatchSize
+			if end > len(fcmDevices) {
+				end = len(fcmDevices)
+			}
+			batch := fcmDevices[start:end]
+
+			tokens := make([]string, len(batch))
+			for i, d := range batch {
+				tokens[i] = d.Token
+			}
+			log.Printf("..sending FCM multicast to %d device(s)", len(batch))
+
+			message := &messaging.MulticastMessage{
+				Notification: fcmNotification,
+				Data:         nc.Data,
+				Android:      androidConfig,
+				APNS:         fcmApnsConfig,
+				Tokens:       tokens,
 			}
 
-			log.Printf("..sending APNS notification to %s", deviceData.NodeNameAtRegistration)
-			res, err := apnsClient.Push(notification)
+			var batchResponse *messaging.BatchResponse
+			err := withRetry(maxSendRetries, func() (bool, error) {
+				var err error
+				batchResponse, err = fcmClient.SendMulticast(context.Background(), message)
+				return err != nil, err
+			})
 			if err != nil {
-				http.Error(w, err.Error(), 500)
-				log.Printf("....unrecoverable error: %s", err.Error())
-				return
+				log.Printf("....error sending FCM batch: %s", err.Error())
+				fcmFailure += len(batch)
+				for _, d := range batch {
+					delivery[d.NodeID] = "error: " + err.Error()
+				}
+				continue
 			}
-			if !res.Sent() {
-				log.Printf("....unable to send notification because %s", res.Reason)
-				// TODO: return error code if all notifications fail?
+
+			for i, resp := range batchResponse.Responses {
+				deviceData := batch[i]
+				if resp.Success {
+					fcmSuccess++
+					delivery[deviceData.NodeID] = "sent"
+					continue
+				}
+				fcmFailure++
+				delivery[deviceData.NodeID] = "error: " + resp.Error.Error()
+				if messaging.IsRegistrationTokenNotRegistered(resp.Error) || messaging.IsInvalidArgument(resp.Error) {
+					log.Printf("....removing dead FCM device %s", deviceData.NodeName)
+					if err := st.DeleteDevice(userID, deviceData.NodeID, "fcm"); err != nil {
+						log.Printf("....unable to remove dead FCM device: %s", err.Error())
+					}
+					delivery[deviceData.NodeID] = "removed: dead token"
+					fcmCleaned = append(fcmCleaned, deviceData.NodeID)
+				}
 			}
 		}
-		// Send to all FCM devices
-		for _, fcmDeviceData := range devices[uid].FcmDevices {
-			log.Printf("..sending FCM notification to %s", fcmDeviceData.NodeNameAtRegistration)
+		if len(fcmDevices) > 0 {
+			log.Printf("..FCM multicast done: %d sent, %d failed, %d cleaned up", fcmSuccess, fcmFailure, len(fcmCleaned))
+		}
 
-			message := &messaging.Message{
-				Notification: &fcmNotification,
-				Android: &messaging.AndroidConfig{
-					Priority: "high",
-				},
-				Token: fcmDeviceData.FcmToken,
+		wnsDevices, err := st.DevicesForUser(userID, "wns")
+		if err != nil {
+			log.Printf("..unable to load WNS devices: %s", err.Error())
+		}
+		wnsDevices = filterDevices(wnsDevices, nc.Device, nc.ExcludeDevice)
+		// Send to all targeted WNS devices
+		for _, wnsDeviceData := range wnsDevices {
+			log.Printf("..sending WNS notification to %s", wnsDeviceData.NodeName)
+
+			wnsType := "wns/raw"
+			var wnsBody []byte
+			if nc.Title != "" {
+				wnsType = "wns/toast"
+				wnsBody = []byte(fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?><toast><visual><binding template="ToastGeneric"><text>%s</text><text>%s</text></binding></visual></toast>`, html.EscapeString(nc.Title), html.EscapeString(nc.Body)))
+			} else {
+				// Reuse the same provider-agnostic title/body/data shape
+				// built for Web Push above, rather than marshaling
+				// NotificationContent itself, which would leak internal
+				// routing fields like Device and ExcludeDevice.
+				wnsBody = webpushPayload
+			}
+
+			sendWns := func(accessToken string) (*http.Response, error) {
+				req, err := http.NewRequest("POST", wnsDeviceData.Token, bytes.NewReader(wnsBody))
+				if err != nil {
+					return nil, err
+				}
+				req.Header.Set("Content-Type", "application/octet-stream")
+				req.Header.Set("X-WNS-Type", wnsType)
+				req.Header.Set("Authorization", "Bearer "+accessToken)
+				return http.DefaultClient.Do(req)
 			}
-			_, err := fcmClient.Send(context.Background(), message)
+
+			var statusCode int
+			err := withRetry(maxSendRetries, func() (bool, error) {
+				accessToken, err := getWnsAccessToken()
+				if err != nil {
+					return true, err
+				}
+
+				res, err := sendWns(accessToken)
+				if err != nil {
+					return true, err
+				}
+				defer res.Body.Close()
+
+				if res.StatusCode == http.StatusUnauthorized {
+					accessToken, err = fetchWnsAccessToken()
+					if err != nil {
+						return true, err
+					}
+					res, err = sendWns(accessToken)
+					if err != nil {
+						return true, err
+					}
+					defer res.Body.Close()
+				}
+
+				statusCode = res.StatusCode
+				if statusCode >= 200 && statusCode < 300 {
+					return false, nil
+				}
+				if statusCode == http.StatusGone || statusCode == http.StatusNotFound {
+					return false, fmt.Errorf("channel gone, status %d", statusCode)
+				}
+				if statusCode >= 500 || statusCode == http.StatusTooManyRequests {
+					return true, fmt.Errorf("WNS returned status %d", statusCode)
+				}
+				return false, fmt.Errorf("WNS returned status %d", statusCode)
+			})
 			if err != nil {
-				http.Error(w, err.Error(), 500)
 				log.Printf("....error: %s", err.Error())
-				return
+				delivery[wnsDeviceData.NodeID] = "error: " + err.Error()
+				if statusCode == http.StatusGone || statusCode == http.StatusNotFound {
+					log.Printf("....removing dead WNS device %s", wnsDeviceData.NodeName)
+					if err := st.DeleteDevice(userID, wnsDeviceData.NodeID, "wns"); err != nil {
+						log.Printf("....unable to remove dead WNS device: %s", err.Error())
+					}
+					delivery[wnsDeviceData.NodeID] = "removed: channel gone"
+				}
+			} else {
+				delivery[wnsDeviceData.NodeID] = "sent"
 			}
 		}
+
+		if vapidPrivateKey != "" {
+			webpushDevices, err := st.DevicesForUser(userID, "webpush")
+			if err != nil {
+				log.Printf("..unable to load Web Push devices: %s", err.Error())
+			}
+			webpushDevices = filterDevices(webpushDevices, nc.Device, nc.ExcludeDevice)
+			// Send to all targeted Web Push subscriptions
+			for _, deviceData := range webpushDevices {
+				var sub webpush.Subscription
+				if err := json.Unmarshal([]byte(deviceData.Token), &sub); err != nil {
+					log.Printf("....unable to parse stored Web Push subscription: %s", err.Error())
+					continue
+				}
+
+				log.Printf("..sending Web Push notification to %s", deviceData.NodeName)
+				opts := &webpush.Options{
+					Subscriber:      *vapidSubject,
+					VAPIDPublicKey:  vapidPublicKey,
+					VAPIDPrivateKey: vapidPrivateKey,
+				}
+				if nc.TTLSeconds > 0 {
+					opts.TTL = nc.TTLSeconds
+				}
+
+				var statusCode int
+				err = withRetry(maxSendRetries, func() (bool, error) {
+					res, err := webpush.SendNotification(webpushPayload, &sub, opts)
+					if err != nil {
+						return true, err
+					}
+					defer res.Body.Close()
+
+					statusCode = res.StatusCode
+					if statusCode >= 200 && statusCode < 300 {
+						return false, nil
+					}
+					if statusCode == http.StatusNotFound || statusCode == http.StatusGone {
+						return false, fmt.Errorf("subscription gone, status %d", statusCode)
+					}
+					if statusCode >= 500 || statusCode == http.StatusTooManyRequests {
+						return true, fmt.Errorf("Web Push returned status %d", statusCode)
+					}
+					return false, fmt.Errorf("Web Push returned status %d", statusCode)
+				})
+				if err != nil {
+					log.Printf("....error: %s", err.Error())
+					delivery[deviceData.NodeID] = "error: " + err.Error()
+					if statusCode == http.StatusNotFound || statusCode == http.StatusGone {
+						log.Printf("....removing dead Web Push subscription %s", deviceData.NodeName)
+						if err := st.DeleteDevice(userID, deviceData.NodeID, "webpush"); err != nil {
+							log.Printf("....unable to remove dead Web Push subscription: %s", err.Error())
+						}
+						delivery[deviceData.NodeID] = "removed: subscription gone"
+					}
+				} else {
+					delivery[deviceData.NodeID] = "sent"
+				}
+			}
+		}
+
+		if err := st.RecordNotification(notificationID, userID, nc.Title, nc.Subtitle, nc.Body, delivery); err != nil {
+			log.Printf("..unable to record notification history: %s", err.Error())
+		}
+	}
+
+	for i := 0; i < *workers; i++ {
+		go func() {
+			for j := range jobQueue {
+				deliverNotification(j.UID, j.Notification, j.NotificationID)
+				markDelivered(j.NotificationID)
+			}
+		}()
 	}
 
+	// MARK: - route setup
+	log.Printf("[8/9] Creating routes")
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("POST /register", func(w http.ResponseWriter, r *http.Request) {
@@ -255,37 +1011,14 @@ func main() {
 
 		log.Printf("APNs token: '%s'", apnsToken)
 
-		if _, ok := devices[who.UserProfile.ID]; !ok {
-			// First device for this user
-			devices[who.UserProfile.ID] = UserData{
-				UsernameAtRegistration: who.UserProfile.LoginName,
-				Devices: map[tailcfg.StableNodeID]DeviceData{
-					who.Node.StableID: DeviceData{
-						NodeNameAtRegistration: who.Node.DisplayName(false),
-						ApnsToken:              apnsToken,
-					},
-				},
-				FcmDevices: map[tailcfg.StableNodeID]FcmDeviceData{},
-			}
-		} else {
-			if devices[who.UserProfile.ID].Devices == nil {
-				devs := map[tailcfg.StableNodeID]DeviceData{
-					who.Node.StableID: DeviceData{
-						NodeNameAtRegistration: who.Node.DisplayName(false),
-						ApnsToken:              apnsToken,
-					},
-				}
-				devices[who.UserProfile.ID] = UserData{
-					UsernameAtRegistration: who.UserProfile.LoginName,
-					Devices:                devs,
-					FcmDevices:             devices[who.UserProfile.ID].FcmDevices,
-				}
-			} else {
-				devices[who.UserProfile.ID].Devices[who.Node.StableID] = DeviceData{
-					NodeNameAtRegistration: who.Node.DisplayName(false),
-					ApnsToken:              apnsToken,
-				}
-			}
+		userID := int64(who.UserProfile.ID)
+		if err := st.UpsertUser(userID, who.UserProfile.LoginName); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if err := st.UpsertDevice(userID, string(who.Node.StableID), "apns", apnsToken, who.Node.DisplayName(false)); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
 		}
 	})
 
@@ -312,37 +1045,76 @@ func main() {
 
 		log.Printf("FCM token: '%s'", fcmToken)
 
-		if _, ok := devices[who.UserProfile.ID]; !ok {
-			// First device for this user
-			devices[who.UserProfile.ID] = UserData{
-				UsernameAtRegistration: who.UserProfile.LoginName,
-				Devices:                map[tailcfg.StableNodeID]DeviceData{},
-				FcmDevices: map[tailcfg.StableNodeID]FcmDeviceData{
-					who.Node.StableID: FcmDeviceData{
-						NodeNameAtRegistration: who.Node.DisplayName(false),
-						FcmToken:               fcmToken,
-					},
-				},
-			}
-		} else {
-			if devices[who.UserProfile.ID].FcmDevices == nil {
-				devs := map[tailcfg.StableNodeID]FcmDeviceData{
-					who.Node.StableID: FcmDeviceData{
-						NodeNameAtRegistration: who.Node.DisplayName(false),
-						FcmToken:               fcmToken,
-					},
-				}
-				devices[who.UserProfile.ID] = UserData{
-					UsernameAtRegistration: who.UserProfile.LoginName,
-					Devices:                devices[who.UserProfile.ID].Devices,
-					FcmDevices:             devs,
-				}
-			} else {
-				devices[who.UserProfile.ID].FcmDevices[who.Node.StableID] = FcmDeviceData{
-					NodeNameAtRegistration: who.Node.DisplayName(false),
-					FcmToken:               fcmToken,
-				}
-			}
+		userID := int64(who.UserProfile.ID)
+		if err := st.UpsertUser(userID, who.UserProfile.LoginName); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if err := st.UpsertDevice(userID, string(who.Node.StableID), "fcm", fcmToken, who.Node.DisplayName(false)); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	})
+
+	mux.HandleFunc("/registerWNS", func(w http.ResponseWriter, r *http.Request) {
+		// Register this device with this Tailscale user
+		who, err := lc.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Printf("Registering WNS device %s for user %s", who.Node.DisplayName(false), who.UserProfile.LoginName)
+
+		bytes, err := io.ReadAll(io.Reader(r.Body))
+		if err != nil {
+			log.Printf("Unable to extract WNS channel URI from request body")
+			http.Error(w, err.Error(), 400)
+		}
+		channelURI := string(bytes)
+
+		log.Printf("WNS channel URI: '%s'", channelURI)
+
+		userID := int64(who.UserProfile.ID)
+		if err := st.UpsertUser(userID, who.UserProfile.LoginName); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if err := st.UpsertDevice(userID, string(who.Node.StableID), "wns", channelURI, who.Node.DisplayName(false)); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	})
+
+	mux.HandleFunc("/registerWebPush", func(w http.ResponseWriter, r *http.Request) {
+		// Register this device with this Tailscale user
+		who, err := lc.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Printf("Registering Web Push device %s for user %s", who.Node.DisplayName(false), who.UserProfile.LoginName)
+
+		var sub webpush.Subscription
+		if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+			log.Printf("Unable to parse Web Push subscription from request body")
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		subJSON, err := json.Marshal(sub)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		userID := int64(who.UserProfile.ID)
+		if err := st.UpsertUser(userID, who.UserProfile.LoginName); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if err := st.UpsertDevice(userID, string(who.Node.StableID), "webpush", string(subJSON), who.Node.DisplayName(false)); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
 		}
 	})
 
@@ -356,9 +1128,17 @@ func main() {
 		log.Printf("Request to send simple notification from user %s", who.UserProfile.LoginName)
 
 		nc := NotificationContent{
-			Body: fmt.Sprintf("Notification triggered by %s", who.Node.DisplayName(false)),
+			Body:          fmt.Sprintf("Notification triggered by %s", who.Node.DisplayName(false)),
+			Device:        r.URL.Query().Get("device"),
+			ExcludeDevice: r.URL.Query().Get("exclude_device"),
 		}
-		sendNotification(w, who.UserProfile.ID, nc)
+		id, err := enqueueJob(who.UserProfile.ID, nc)
+		if err != nil {
+			log.Printf("..unable to persist queued notification: %s", err.Error())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"notification_id": id})
 	})
 
 	mux.HandleFunc("POST /send", func(w http.ResponseWriter, r *http.Request) {
@@ -376,10 +1156,10 @@ func main() {
 			return
 		}
 
-		nc := NotificationContent{
-			Title:    r.Form["title"][0],
-			Subtitle: r.Form["subtitle"][0],
-			Body:     r.Form["body"][0],
+		nc, err := notificationContentFromForm(r.Form)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
 		}
 
 		if nc.Title == "" && nc.Body == "" {
@@ -389,7 +1169,13 @@ func main() {
 			return
 		}
 
-		sendNotification(w, who.UserProfile.ID, nc)
+		id, err := enqueueJob(who.UserProfile.ID, nc)
+		if err != nil {
+			log.Printf("..unable to persist queued notification: %s", err.Error())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"notification_id": id})
 	})
 
 	mux.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
@@ -421,7 +1207,13 @@ func main() {
 			return
 		}
 
-		sendNotification(w, who.UserProfile.ID, nc)
+		id, err := enqueueJob(who.UserProfile.ID, nc)
+		if err != nil {
+			log.Printf("..unable to persist queued notification: %s", err.Error())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"notification_id": id})
 	})
 
 	mux.HandleFunc("/sendJSON", func(w http.ResponseWriter, r *http.Request) {
@@ -429,11 +1221,82 @@ func main() {
 		return
 	})
 
-	// TODO: Potential future endpoints to eliminate notifications when viewed on other devices
-	// https://stackoverflow.com/questions/34549453/how-to-sync-push-notifications-across-multiple-ios-devices
+	mux.HandleFunc("GET /history", func(w http.ResponseWriter, r *http.Request) {
+		who, err := lc.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		limit := 50
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			parsed, err := strconv.Atoi(raw)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "invalid limit", 400)
+				return
+			}
+			limit = parsed
+		}
+
+		history, err := st.History(int64(who.UserProfile.ID), limit)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		entries := make([]notificationHistoryEntry, len(history))
+		for i, n := range history {
+			success, failure, cleaned := summarizeDelivery(n.Delivery)
+			entries[i] = notificationHistoryEntry{Notification: n, Success: success, Failure: failure, Cleaned: cleaned}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	})
+
+	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	})
+
+	mux.HandleFunc("POST /dismiss", func(w http.ResponseWriter, r *http.Request) {
+		// Tell a user's other devices to locally remove a notification they
+		// already acted on, via a silent push.
+		who, err := lc.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		notificationID := r.Form.Get("notification_id")
+		if notificationID == "" {
+			http.Error(w, "notification_id is required", 400)
+			return
+		}
+		log.Printf("Request to dismiss notification %s from user %s", notificationID, who.UserProfile.LoginName)
+
+		nc := NotificationContent{
+			Silent:        true,
+			Data:          map[string]string{"dismiss": notificationID},
+			ExcludeDevice: string(who.Node.StableID),
+		}
+		if _, err := enqueueJob(who.UserProfile.ID, nc); err != nil {
+			log.Printf("..unable to persist queued notification: %s", err.Error())
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	mux.HandleFunc("/dismiss", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	})
 
 	// MARK: - run
-	log.Printf("[6/6] Launching server")
+	log.Printf("[9/9] Launching server")
 
 	log.Fatal(http.Serve(listener, mux))
 }
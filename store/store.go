@@ -0,0 +1,275 @@
+// Package store provides the SQLite-backed persistence layer for cliff:
+// registered users, their push devices, a history of sent notifications,
+// and the not-yet-delivered job queue. It replaces the devices.gob snapshot
+// that used to be decoded into memory on startup and flushed on shutdown.
+package store
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Device is a single push-capable endpoint registered for a user.
+type Device struct {
+	NodeID       string
+	Provider     string // one of "apns", "fcm", "wns", "webpush"
+	Token        string // provider-specific opaque token/URI
+	NodeName     string
+	RegisteredAt time.Time
+	LastSeen     time.Time
+}
+
+// Notification is a record of an outbound notification and, per device, the
+// result of attempting to deliver it.
+type Notification struct {
+	ID       string
+	UserID   int64
+	Title    string
+	Subtitle string
+	Body     string
+	SentAt   time.Time
+	Delivery map[string]string // node ID -> delivery result
+}
+
+// QueuedJob is a not-yet-delivered notification send, persisted so it isn't
+// dropped if the process restarts before delivery finishes. Data is an
+// opaque, caller-defined encoding of the job; the store doesn't need to
+// understand it, only to hold onto it until DequeueJob is called.
+type QueuedJob struct {
+	ID     string
+	UserID int64
+	Data   []byte
+}
+
+// Store wraps the SQLite database holding users, devices, and notification
+// history.
+type Store struct {
+	db *sql.DB
+}
+
+// Open creates (if necessary) and opens the SQLite database at path,
+// creating the schema on first use. WAL mode plus a busy timeout let the
+// delivery workers and HTTP handlers write concurrently instead of hitting
+// SQLITE_BUSY the instant two goroutines touch the database at once.
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) migrate() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS users (
+			user_id INTEGER PRIMARY KEY,
+			username TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS devices (
+			user_id INTEGER NOT NULL,
+			node_id TEXT NOT NULL,
+			provider TEXT NOT NULL,
+			token TEXT NOT NULL,
+			node_name TEXT NOT NULL,
+			registered_at DATETIME NOT NULL,
+			last_seen DATETIME NOT NULL,
+			PRIMARY KEY (user_id, node_id, provider)
+		);
+		CREATE TABLE IF NOT EXISTS notifications (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			title TEXT NOT NULL,
+			subtitle TEXT NOT NULL,
+			body TEXT NOT NULL,
+			sent_at DATETIME NOT NULL,
+			delivery_json TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS queued_jobs (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			data BLOB NOT NULL
+		);
+	`)
+	return err
+}
+
+// Close closes the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// UpsertUser records the most recently seen username for a user ID.
+func (s *Store) UpsertUser(userID int64, username string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO users (user_id, username) VALUES (?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET username = excluded.username
+	`, userID, username)
+	return err
+}
+
+// UpsertDevice records (or refreshes) a single push device for a user.
+func (s *Store) UpsertDevice(userID int64, nodeID, provider, token, nodeName string) error {
+	now := time.Now()
+	_, err := s.db.Exec(`
+		INSERT INTO devices (user_id, node_id, provider, token, node_name, registered_at, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, node_id, provider) DO UPDATE SET
+			token = excluded.token,
+			node_name = excluded.node_name,
+			last_seen = excluded.last_seen
+	`, userID, nodeID, provider, token, nodeName, now, now)
+	return err
+}
+
+// DeleteDevice removes a single push device, e.g. after the provider reports
+// it as dead.
+func (s *Store) DeleteDevice(userID int64, nodeID, provider string) error {
+	_, err := s.db.Exec(`DELETE FROM devices WHERE user_id = ? AND node_id = ? AND provider = ?`, userID, nodeID, provider)
+	return err
+}
+
+// DevicesForUser returns every device registered for a user under the given
+// provider.
+func (s *Store) DevicesForUser(userID int64, provider string) ([]Device, error) {
+	rows, err := s.db.Query(`
+		SELECT node_id, provider, token, node_name, registered_at, last_seen
+		FROM devices WHERE user_id = ? AND provider = ?
+	`, userID, provider)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []Device
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.NodeID, &d.Provider, &d.Token, &d.NodeName, &d.RegisteredAt, &d.LastSeen); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// AllDevicesForUser returns every device registered for a user, across all
+// providers.
+func (s *Store) AllDevicesForUser(userID int64) ([]Device, error) {
+	rows, err := s.db.Query(`
+		SELECT node_id, provider, token, node_name, registered_at, last_seen
+		FROM devices WHERE user_id = ?
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []Device
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.NodeID, &d.Provider, &d.Token, &d.NodeName, &d.RegisteredAt, &d.LastSeen); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// RecordNotification stores a sent notification, identified by the caller's
+// notification ID (see NewID), along with its per-device delivery results.
+func (s *Store) RecordNotification(id string, userID int64, title, subtitle, body string, delivery map[string]string) error {
+	deliveryJSON, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO notifications (id, user_id, title, subtitle, body, sent_at, delivery_json)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, id, userID, title, subtitle, body, time.Now(), string(deliveryJSON))
+	return err
+}
+
+// History returns the most recent notifications sent to a user, newest
+// first.
+func (s *Store) History(userID int64, limit int) ([]Notification, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, title, subtitle, body, sent_at, delivery_json
+		FROM notifications WHERE user_id = ? ORDER BY sent_at DESC LIMIT ?
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		var deliveryJSON string
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Title, &n.Subtitle, &n.Body, &n.SentAt, &deliveryJSON); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(deliveryJSON), &n.Delivery); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// EnqueueJob persists a not-yet-delivered job so it survives a crash between
+// being enqueued and being delivered. Call DequeueJob once it's delivered
+// (or permanently given up on) so the queue doesn't grow without bound.
+func (s *Store) EnqueueJob(id string, userID int64, data []byte) error {
+	_, err := s.db.Exec(`INSERT INTO queued_jobs (id, user_id, data) VALUES (?, ?, ?)`, id, userID, data)
+	return err
+}
+
+// DequeueJob removes a single job from the persisted queue.
+func (s *Store) DequeueJob(id string) error {
+	_, err := s.db.Exec(`DELETE FROM queued_jobs WHERE id = ?`, id)
+	return err
+}
+
+// QueuedJobs returns every job left over from a previous run, e.g. because
+// the process restarted before it could be delivered.
+func (s *Store) QueuedJobs() ([]QueuedJob, error) {
+	rows, err := s.db.Query(`SELECT id, user_id, data FROM queued_jobs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []QueuedJob
+	for rows.Next() {
+		var j QueuedJob
+		if err := rows.Scan(&j.ID, &j.UserID, &j.Data); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// NewID returns a random RFC 4122 version 4 UUID, suitable for identifying a
+// notification before it has been recorded (e.g. so a caller can hand it
+// back to a client that may later want to reference it, such as /dismiss).
+func NewID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}